@@ -0,0 +1,127 @@
+package kms
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// Sentinel errors returned by ClassifyError for the terminal KMS error codes
+// that require operator action (rotating keys, restoring access) rather than
+// a retry.
+var (
+	// ErrKeyDisabled means the CMK is disabled and cannot be used until it
+	// is re-enabled.
+	ErrKeyDisabled = errors.New("kms: key is disabled")
+	// ErrKeyInvalidState means the CMK is in a state that doesn't allow the
+	// requested operation (e.g. pending import, pending deletion, disabled
+	// for rotation). KMSInvalidStateException doesn't carry a separate code
+	// per state, only a human-readable message, so this is the default for
+	// that error code; ClassifyError narrows it to ErrKeyPendingDeletion
+	// when the message says so.
+	ErrKeyInvalidState = errors.New("kms: key is in an invalid state for this operation")
+	// ErrKeyPendingDeletion means the CMK is scheduled for deletion. It can
+	// be recovered with CancelKeyDeletion before the deletion window ends.
+	ErrKeyPendingDeletion = errors.New("kms: key is pending deletion")
+	// ErrKeyAccessDenied means the caller does not have permission to use
+	// the CMK.
+	ErrKeyAccessDenied = errors.New("kms: access denied to key")
+	// ErrKeyNotFound means the CMK does not exist, or the caller does not
+	// have permission to see it exist.
+	ErrKeyNotFound = errors.New("kms: key not found")
+)
+
+// pendingDeletionMessageSubstring is the text AWS KMS includes in a
+// KMSInvalidStateException's message when the CMK is pending deletion, the
+// only InvalidState case sops knows how to recover from automatically.
+const pendingDeletionMessageSubstring = "pending deletion"
+
+// retryableCodes are AWS KMS error codes that indicate a transient
+// condition and are safe to retry.
+var retryableCodes = map[string]bool{
+	"ThrottlingException":        true,
+	"TooManyRequestsException":   true,
+	"KMSInternalException":       true,
+	"DependencyTimeoutException": true,
+}
+
+// terminalErrors maps non-retryable KMS error codes to the sentinel error
+// that describes them.
+var terminalErrors = map[string]error{
+	"KMSAccessDeniedException": ErrKeyAccessDenied,
+	"KMSDisabledException":     ErrKeyDisabled,
+	"KMSInvalidStateException": ErrKeyInvalidState,
+	"KMSNotFoundException":     ErrKeyNotFound,
+}
+
+// IsRetryable reports whether err represents a transient AWS KMS error that
+// is safe to retry.
+func IsRetryable(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return retryableCodes[aerr.Code()]
+	}
+	return false
+}
+
+// ClassifyError maps an error returned by the AWS KMS client to one of this
+// package's sentinel errors when it recognizes the underlying error code.
+// Unrecognized errors are returned unchanged. A KMSInvalidStateException is
+// narrowed to ErrKeyPendingDeletion only when its message says the CMK is
+// pending deletion; other invalid states (e.g. pending import) come back as
+// the more general ErrKeyInvalidState, since CancelKeyDeletion would be the
+// wrong recovery for those.
+func ClassifyError(err error) error {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return err
+	}
+	sentinel, ok := terminalErrors[aerr.Code()]
+	if !ok {
+		return err
+	}
+	if sentinel == ErrKeyInvalidState && strings.Contains(strings.ToLower(aerr.Message()), pendingDeletionMessageSubstring) {
+		return ErrKeyPendingDeletion
+	}
+	return sentinel
+}
+
+// MultiError aggregates the per-key errors encountered while walking a list
+// of KMS master keys, so that one key's terminal failure doesn't prevent the
+// caller from using the keys that succeeded.
+type MultiError struct {
+	Errors []error
+}
+
+func (e *MultiError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Append adds err to the MultiError if err is non-nil, and returns the
+// MultiError itself. This lets callers do `merr = merr.Append(err)` in a
+// loop and call ErrorOrNil() at the end.
+func (e *MultiError) Append(err error) *MultiError {
+	if err == nil {
+		return e
+	}
+	if e == nil {
+		e = &MultiError{}
+	}
+	e.Errors = append(e.Errors, err)
+	return e
+}
+
+// ErrorOrNil returns e as an error if it holds any errors, or a true nil
+// error otherwise. Returning e directly when it is a nil *MultiError would
+// produce a non-nil error interface, so callers should return
+// merr.ErrorOrNil() rather than merr itself.
+func (e *MultiError) ErrorOrNil() error {
+	if e == nil || len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
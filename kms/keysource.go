@@ -0,0 +1,156 @@
+package kms
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awskms "github.com/aws/aws-sdk-go/service/kms"
+)
+
+// KMSTTL is the duration after which a MasterKey requires rotation.
+const KMSTTL = time.Hour * 24 * 30 * 6
+
+// KMSMasterKey is a AWS KMS key used to encrypt and decrypt sops' data key.
+type KMSMasterKey struct {
+	Arn          string
+	Role         string
+	EncryptedKey string
+	CreationDate time.Time
+
+	// RecoverKeyOnPendingDeletion controls whether Decrypt will attempt to
+	// call CancelKeyDeletion when it encounters a CMK that is pending
+	// deletion. It is opt-in because cancelling a scheduled deletion is a
+	// destructive, auditable action that a caller should consent to.
+	RecoverKeyOnPendingDeletion bool
+
+	// MaxRetries overrides the number of attempts made for this key's
+	// Encrypt/Decrypt calls before giving up on a retryable error. Zero (the
+	// default) means DefaultMaxRetries.
+	MaxRetries int
+}
+
+// NewMasterKeyFromArn takes an ARN, returns a KMS master key and initializes
+// it with the ARN and the role (which can be empty).
+func NewMasterKeyFromArn(arn string, role string) *KMSMasterKey {
+	k := &KMSMasterKey{}
+	arn = strings.Replace(arn, " ", "", -1)
+	roles := strings.Split(arn, "+")
+	k.Arn = roles[0]
+	if len(roles) > 1 {
+		k.Role = roles[1]
+	} else {
+		k.Role = role
+	}
+	k.CreationDate = time.Now().UTC()
+	return k
+}
+
+func (key *KMSMasterKey) createSession() *session.Session {
+	sess := session.Must(session.NewSession())
+	if key.Role != "" {
+		sess.Config.Credentials = stscreds.NewCredentials(sess, key.Role)
+	}
+	return sess
+}
+
+// Encrypt takes a sops data key, encrypts it with KMS and stores the result
+// in the EncryptedKey field.
+func (key *KMSMasterKey) Encrypt(dataKey []byte) error {
+	svc := awskms.New(key.createSession())
+	out, err := withRetry(func() (interface{}, error) {
+		return svc.Encrypt(&awskms.EncryptInput{
+			Plaintext: dataKey,
+			KeyId:     aws.String(key.Arn),
+		})
+	}, key.MaxRetries)
+	if err != nil {
+		return fmt.Errorf("Error encrypting data key with AWS KMS: %v", err)
+	}
+	key.EncryptedKey = base64.StdEncoding.EncodeToString(out.(*awskms.EncryptOutput).CiphertextBlob)
+	return nil
+}
+
+// EncryptIfNeeded encrypts the key only if it's needed, that is, if it hasn't
+// been encrypted already.
+func (key *KMSMasterKey) EncryptIfNeeded(dataKey []byte) error {
+	if key.EncryptedKey == "" {
+		return key.Encrypt(dataKey)
+	}
+	return nil
+}
+
+// Decrypt decrypts the EncryptedKey with KMS and returns the result.
+//
+// Transient KMS errors (throttling, internal errors, dependency timeouts)
+// are retried with a jittered exponential backoff. Terminal errors are
+// returned wrapping one of the Err* sentinels in this package (match them
+// with errors.Is) so callers can tell
+// "rotate this key" from "retry later". If the key's error is
+// ErrKeyPendingDeletion and RecoverKeyOnPendingDeletion is set, Decrypt
+// attempts to cancel the scheduled deletion once before giving up.
+func (key *KMSMasterKey) Decrypt() ([]byte, error) {
+	k, err := base64.StdEncoding.DecodeString(key.EncryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("Error base64-decoding encrypted data key: %s", err)
+	}
+	svc := awskms.New(key.createSession())
+	decrypt := func() (interface{}, error) {
+		return svc.Decrypt(&awskms.DecryptInput{CiphertextBlob: k})
+	}
+	out, err := withRetry(decrypt, key.MaxRetries)
+	if err != nil {
+		classified := ClassifyError(err)
+		if classified == ErrKeyPendingDeletion && key.RecoverKeyOnPendingDeletion {
+			if recoverErr := key.CancelKeyDeletion(); recoverErr == nil {
+				out, err = withRetry(decrypt, key.MaxRetries)
+				if err == nil {
+					return out.(*awskms.DecryptOutput).Plaintext, nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("Error decrypting key %q with AWS KMS: %w", key.Arn, classified)
+	}
+	return out.(*awskms.DecryptOutput).Plaintext, nil
+}
+
+// CancelKeyDeletion cancels a scheduled deletion of the CMK backing this
+// master key, re-enabling it for use. Callers opt into automatic recovery by
+// setting RecoverKeyOnPendingDeletion; this method can also be called
+// directly for manual recovery flows.
+func (key *KMSMasterKey) CancelKeyDeletion() error {
+	svc := awskms.New(key.createSession())
+	_, err := svc.CancelKeyDeletion(&awskms.CancelKeyDeletionInput{
+		KeyId: aws.String(key.Arn),
+	})
+	if err != nil {
+		return fmt.Errorf("Error cancelling deletion of KMS key %q: %v", key.Arn, err)
+	}
+	return nil
+}
+
+// NeedsRotation returns whether the data key needs to be rotated or not.
+func (key *KMSMasterKey) NeedsRotation() bool {
+	return time.Since(key.CreationDate) > KMSTTL
+}
+
+// ToString converts the key to a string representation.
+func (key *KMSMasterKey) ToString() string {
+	return key.Arn
+}
+
+// ToMap converts the MasterKey to a map for serialization purposes.
+func (key *KMSMasterKey) ToMap() map[string]interface{} {
+	out := make(map[string]interface{})
+	out["arn"] = key.Arn
+	if key.Role != "" {
+		out["role"] = key.Role
+	}
+	out["created_at"] = key.CreationDate.UTC().Format(time.RFC3339)
+	out["enc"] = key.EncryptedKey
+	return out
+}
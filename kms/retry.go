@@ -0,0 +1,53 @@
+package kms
+
+import (
+	"math/rand"
+	"time"
+)
+
+// DefaultMaxRetries is the number of attempts made for a KMS Encrypt or
+// Decrypt call before giving up on a retryable error, when the caller (e.g.
+// KMSMasterKey.MaxRetries) doesn't configure a different value.
+const DefaultMaxRetries = 5
+
+const (
+	retryBase = 200 * time.Millisecond
+	retryCap  = 10 * time.Second
+)
+
+// backoff computes a jittered exponential backoff duration for the given
+// attempt number (0-indexed): min(cap, base*2^attempt) * rand(0.5..1.5).
+func backoff(attempt int) time.Duration {
+	d := retryBase << uint(attempt)
+	if d > retryCap || d < 0 {
+		d = retryCap
+	}
+	jitter := 0.5 + rand.Float64()
+	return time.Duration(float64(d) * jitter)
+}
+
+// withRetry calls fn up to maxRetries times (falling back to
+// DefaultMaxRetries when maxRetries is 0), retrying only when the returned
+// error is classified as retryable, and sleeping a jittered exponential
+// backoff between attempts.
+func withRetry(fn func() (interface{}, error), maxRetries int) (interface{}, error) {
+	if maxRetries == 0 {
+		maxRetries = DefaultMaxRetries
+	}
+	var err error
+	var out interface{}
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		out, err = fn()
+		if err == nil {
+			return out, nil
+		}
+		if !IsRetryable(err) {
+			return nil, err
+		}
+		if attempt == maxRetries-1 {
+			break
+		}
+		time.Sleep(backoff(attempt))
+	}
+	return nil, err
+}
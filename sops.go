@@ -0,0 +1,92 @@
+// Package sops provides the data structures and interfaces shared by every
+// store (yaml, json, ini, ...) and key management backend (kms, pgp, ...)
+// in this project.
+package sops
+
+import "time"
+
+// DateFormat is the time format used to serialize dates in sops metadata.
+const DateFormat = "2006-01-02T15:04:05Z"
+
+// TreeBranch represents a set of keys and associated values, either of which
+// can again be a TreeBranch, recursively.
+type TreeBranch []TreeItem
+
+// TreeItem is a key/value pair of a TreeBranch. When Value is a YAML
+// sequence, it is a []SequenceItem rather than a plain []interface{}, so
+// that comments on individual sequence items survive alongside it.
+type TreeItem struct {
+	Key   string
+	Value interface{}
+
+	// HeadComment, LineComment and FootComment carry the comments
+	// attached to this item's key in the original document, if any. They
+	// are nil unless the store that produced this TreeItem supports
+	// comments (currently only yaml). Stores that don't support comments
+	// (json, ini) leave them nil and ignore them on Dump. A bare blank
+	// line with no comment text of its own is represented as a leading
+	// "\n" in the following item's HeadComment (see YAMLStore.nodeToTreeBranch).
+	HeadComment *string
+	LineComment *string
+	FootComment *string
+}
+
+// SequenceItem is an element of a YAML sequence, carrying any comments
+// attached directly to it. It's the sequence counterpart of TreeItem: a
+// plain value there has no slot for comments of its own, so a sequence's
+// Value is built out of these instead of raw interface{} elements whenever
+// it came from a store (like yaml) that supports comments.
+type SequenceItem struct {
+	Value interface{}
+
+	HeadComment *string
+	LineComment *string
+	FootComment *string
+}
+
+// MasterKey is the interface a key management mechanism needs to implement
+// to be used to encrypt/decrypt the data key sops uses to encrypt and
+// decrypt files.
+type MasterKey interface {
+	Encrypt(dataKey []byte) error
+	EncryptIfNeeded(dataKey []byte) error
+	Decrypt() ([]byte, error)
+	NeedsRotation() bool
+	ToString() string
+	ToMap() map[string]interface{}
+}
+
+// KeySource is a list of MasterKeys along with the name of the method used
+// to retrieve them, for example "kms" or "pgp".
+type KeySource struct {
+	Name string
+	Keys []MasterKey
+}
+
+// Metadata holds information about a file encrypted by sops, including the
+// MACs of the file's content and all the master keys that can be used to
+// decrypt it.
+type Metadata struct {
+	LastModified              time.Time
+	UnencryptedSuffix         string
+	MessageAuthenticationCode string
+	Version                   string
+	KeySources                []KeySource
+}
+
+// ToMap converts the Metadata to a map for serialization purposes.
+func (m Metadata) ToMap() map[string]interface{} {
+	out := make(map[string]interface{})
+	out["lastmodified"] = m.LastModified.Format(DateFormat)
+	out["unencrypted_suffix"] = m.UnencryptedSuffix
+	out["mac"] = m.MessageAuthenticationCode
+	out["version"] = m.Version
+	for _, ks := range m.KeySources {
+		var keys []map[string]interface{}
+		for _, k := range ks.Keys {
+			keys = append(keys, k.ToMap())
+		}
+		out[ks.Name] = keys
+	}
+	return out
+}
@@ -0,0 +1,71 @@
+package yaml
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadAllRejectsMixedEmptyAndNonEmptyDocuments(t *testing.T) {
+	in := "foo: bar\n---\n---\nbaz: qux\n"
+	_, err := YAMLStore{}.LoadAll(in)
+	if err == nil {
+		t.Fatal("expected an error for a stream mixing an empty document with non-empty ones, got nil")
+	}
+	if !strings.Contains(err.Error(), "empty document") {
+		t.Fatalf("expected the error to call out the empty document, got: %s", err)
+	}
+}
+
+func TestLoadAllAcceptsAllEmptyDocuments(t *testing.T) {
+	in := "---\n---\n"
+	branches, err := YAMLStore{}.LoadAll(in)
+	if err != nil {
+		t.Fatalf("a stream of only empty documents should not be rejected: %s", err)
+	}
+	if len(branches) != 2 {
+		t.Fatalf("expected 2 empty branches, got %d", len(branches))
+	}
+}
+
+func TestLoadMetadataRejectsConflictingUnencryptedSuffix(t *testing.T) {
+	in := `foo: bar
+sops:
+  mac: ENC[AES256_GCM,data:Zm9v,type:str]
+  lastmodified: "2023-01-01T00:00:00Z"
+  unencrypted_suffix: "_unencrypted_a"
+  version: "3.7.1"
+---
+baz: qux
+sops:
+  mac: ENC[AES256_GCM,data:YmF6,type:str]
+  lastmodified: "2023-01-01T00:00:00Z"
+  unencrypted_suffix: "_unencrypted_b"
+  version: "3.7.1"
+`
+	_, err := (&YAMLStore{}).LoadMetadata(in)
+	if err == nil {
+		t.Fatal("expected an error for documents with conflicting unencrypted_suffix values, got nil")
+	}
+	if !strings.Contains(err.Error(), "conflicting unencrypted_suffix") {
+		t.Fatalf("expected the error to call out the conflicting unencrypted_suffix, got: %s", err)
+	}
+}
+
+func TestLoadMetadataFindsFirstSopsBlock(t *testing.T) {
+	in := `foo: bar
+sops:
+  mac: ENC[AES256_GCM,data:Zm9v,type:str]
+  lastmodified: "2023-01-01T00:00:00Z"
+  unencrypted_suffix: "_unencrypted"
+  version: "3.7.1"
+---
+baz: qux
+`
+	metadata, err := (&YAMLStore{}).LoadMetadata(in)
+	if err != nil {
+		t.Fatalf("LoadMetadata returned an error: %s", err)
+	}
+	if metadata.UnencryptedSuffix != "_unencrypted" {
+		t.Fatalf("expected unencrypted_suffix %q, got %q", "_unencrypted", metadata.UnencryptedSuffix)
+	}
+}
@@ -1,128 +1,404 @@
 package yaml
 
 import (
+	"bytes"
 	"fmt"
-	"github.com/autrilla/yaml"
+	"io"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+
 	"go.mozilla.org/sops"
 	"go.mozilla.org/sops/kms"
 	"go.mozilla.org/sops/pgp"
-	"time"
 )
 
 type YAMLStore struct {
 }
 
-func (store YAMLStore) mapSliceToTreeBranch(in yaml.MapSlice) sops.TreeBranch {
-	branch := make(sops.TreeBranch, 0)
-	for _, item := range in {
-		branch = append(branch, sops.TreeItem{
-			Key:   item.Key.(string),
-			Value: store.yamlValueToTreeValue(item.Value),
-		})
+// commentOrNil turns a raw *yaml.Node comment string into the *string sops
+// uses on TreeItem, so that "no comment" and "empty comment" both come out
+// as nil rather than one being nil and the other an empty string.
+func commentOrNil(s string) *string {
+	if s == "" {
+		return nil
 	}
-	return branch
+	return &s
 }
 
-func (store YAMLStore) Load(in string) (sops.TreeBranch, error) {
-	var data yaml.MapSlice
-	if err := yaml.Unmarshal([]byte(in), &data); err != nil {
-		return nil, fmt.Errorf("Error unmarshaling input YAML: %s", err)
+// lineComment picks the inline ("# ...") comment for a mapping entry.
+// yaml.v3 attaches a trailing comment on a `key: value # comment` line to
+// the value node, not the key node, so the value node's LineComment is
+// checked first; the key node is only a fallback for the rare case of a
+// key-only line (e.g. an empty value) carrying its own trailing comment.
+func lineComment(keyNode, valueNode *yaml.Node) string {
+	if valueNode.LineComment != "" {
+		return valueNode.LineComment
 	}
-	for i, item := range data {
-		if item.Key == "sops" {
-			data = append(data[:i], data[i+1:]...)
+	return keyNode.LineComment
+}
+
+// commentLineCount returns the number of source lines c's text occupies, or
+// 0 if there's no comment at all. Used to work back from a node's Line to
+// where a comment block attached to it actually starts.
+func commentLineCount(c string) int {
+	if c == "" {
+		return 0
+	}
+	return strings.Count(c, "\n") + 1
+}
+
+// lastLine returns the furthest source line reached by node or any of its
+// descendants, so that the gap between it and the next sibling's comment
+// block can be measured in blank lines.
+func lastLine(node *yaml.Node) int {
+	line := node.Line
+	for _, child := range node.Content {
+		if l := lastLine(child); l > line {
+			line = l
 		}
 	}
-	return store.mapSliceToTreeBranch(data), nil
+	return line
 }
 
-func (store YAMLStore) yamlValueToTreeValue(in interface{}) interface{} {
-	switch in := in.(type) {
-	case map[interface{}]interface{}:
-		return store.yamlMapToTreeBranch(in)
-	case yaml.MapSlice:
-		return store.mapSliceToTreeBranch(in)
-	case []interface{}:
-		return store.yamlSliceToTreeValue(in)
+func (store YAMLStore) nodeToTreeBranch(node *yaml.Node) (sops.TreeBranch, error) {
+	if node.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("Error unmarshaling input YAML: expected a mapping, got %d", node.Kind)
+	}
+	branch := make(sops.TreeBranch, 0, len(node.Content)/2)
+	prevEnd := -1
+	for i := 0; i < len(node.Content); i += 2 {
+		keyNode, valueNode := node.Content[i], node.Content[i+1]
+		value, err := store.nodeToTreeValue(valueNode)
+		if err != nil {
+			return nil, err
+		}
+		headComment := keyNode.HeadComment
+		// A bare blank line carries no comment text of its own, so yaml.v3
+		// doesn't record it anywhere -- but it does still move keyNode.Line
+		// forward. If the gap between the previous item's last line and
+		// where this item's head comment (if any) starts is more than one
+		// line, that gap is blank lines; represent them the same way
+		// DumpAllWithMetadata's sopsKeyNode does, as leading "\n"s on the
+		// head comment, so treeBranchToNode can reproduce them unchanged.
+		if prevEnd >= 0 {
+			commentStart := keyNode.Line - commentLineCount(headComment)
+			if blank := commentStart - prevEnd - 1; blank > 0 {
+				headComment = strings.Repeat("\n", blank) + headComment
+			}
+		}
+		branch = append(branch, sops.TreeItem{
+			Key:         keyNode.Value,
+			Value:       value,
+			HeadComment: commentOrNil(headComment),
+			LineComment: commentOrNil(lineComment(keyNode, valueNode)),
+			FootComment: commentOrNil(keyNode.FootComment),
+		})
+		prevEnd = lastLine(valueNode) + commentLineCount(keyNode.FootComment)
+	}
+	return branch, nil
+}
+
+// nodeToTreeValue converts a value node recursively.
+func (store YAMLStore) nodeToTreeValue(node *yaml.Node) (interface{}, error) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		return store.nodeToTreeBranch(node)
+	case yaml.SequenceNode:
+		values := make([]sops.SequenceItem, 0, len(node.Content))
+		for _, item := range node.Content {
+			value, err := store.nodeToTreeValue(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, sops.SequenceItem{
+				Value:       value,
+				HeadComment: commentOrNil(item.HeadComment),
+				LineComment: commentOrNil(item.LineComment),
+				FootComment: commentOrNil(item.FootComment),
+			})
+		}
+		return values, nil
 	default:
-		return in
+		var value interface{}
+		if err := node.Decode(&value); err != nil {
+			return nil, fmt.Errorf("Error unmarshaling input YAML: %s", err)
+		}
+		return value, nil
 	}
 }
 
-func (store *YAMLStore) yamlSliceToTreeValue(in []interface{}) []interface{} {
-	for i, v := range in {
-		in[i] = store.yamlValueToTreeValue(v)
+// isEmptyDoc reports whether a decoded document is empty: either it has no
+// root node at all, or (the common case, e.g. for a "---\n---\n" stream)
+// yaml.v3 gave it a root scalar node tagged "!!null".
+func isEmptyDoc(doc *yaml.Node) bool {
+	if len(doc.Content) == 0 {
+		return true
 	}
-	return in
+	root := doc.Content[0]
+	return root.Kind == yaml.ScalarNode && root.Tag == "!!null"
 }
 
-func (store *YAMLStore) yamlMapToTreeBranch(in map[interface{}]interface{}) sops.TreeBranch {
-	branch := make(sops.TreeBranch, 0)
-	for k, v := range in {
-		branch = append(branch, sops.TreeItem{
-			Key:   k.(string),
-			Value: store.yamlValueToTreeValue(v),
-		})
+// docToTreeBranch turns a single parsed document node into a sops.TreeBranch,
+// stripping out the `sops` metadata key if present: it's read separately
+// through LoadMetadata.
+func (store YAMLStore) docToTreeBranch(doc *yaml.Node) (sops.TreeBranch, error) {
+	if isEmptyDoc(doc) {
+		return sops.TreeBranch{}, nil
+	}
+	branch, err := store.nodeToTreeBranch(doc.Content[0])
+	if err != nil {
+		return nil, err
+	}
+	for i, item := range branch {
+		if item.Key == "sops" {
+			branch = append(branch[:i], branch[i+1:]...)
+			break
+		}
+	}
+	return branch, nil
+}
+
+// LoadAll parses a `---`-separated multi-document YAML stream into one
+// sops.TreeBranch per document, in stream order, using yaml.v3's node API so
+// that comments attached to keys survive the round trip through
+// Dump/DumpAll. A stream mixing empty documents with non-empty ones is
+// rejected, since it's ambiguous which documents sops should encrypt.
+func (store YAMLStore) LoadAll(in string) ([]sops.TreeBranch, error) {
+	decoder := yaml.NewDecoder(strings.NewReader(in))
+	var branches []sops.TreeBranch
+	var emptyDocs []int
+	for i := 0; ; i++ {
+		var doc yaml.Node
+		err := decoder.Decode(&doc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error unmarshaling input YAML: %s", err)
+		}
+		if isEmptyDoc(&doc) {
+			emptyDocs = append(emptyDocs, i)
+		}
+		branch, err := store.docToTreeBranch(&doc)
+		if err != nil {
+			return nil, err
+		}
+		branches = append(branches, branch)
+	}
+	if len(emptyDocs) > 0 && len(emptyDocs) != len(branches) {
+		return nil, fmt.Errorf("Error unmarshaling input YAML: empty document(s) %v mixed with non-empty documents in the same stream", emptyDocs)
+	}
+	return branches, nil
+}
+
+// Load parses a single-document YAML input into a sops.TreeBranch. Streams
+// with more than one document should use LoadAll instead.
+func (store YAMLStore) Load(in string) (sops.TreeBranch, error) {
+	branches, err := store.LoadAll(in)
+	if err != nil {
+		return nil, err
+	}
+	if len(branches) == 0 {
+		return sops.TreeBranch{}, nil
 	}
-	return branch
+	return branches[0], nil
 }
 
-func (store YAMLStore) treeValueToYamlValue(in interface{}) interface{} {
+func (store YAMLStore) treeValueToNode(in interface{}) (*yaml.Node, error) {
 	switch in := in.(type) {
 	case sops.TreeBranch:
-		return store.treeBranchToYamlMap(in)
+		return store.treeBranchToNode(in)
+	case []sops.SequenceItem:
+		seq := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, item := range in {
+			node, err := store.treeValueToNode(item.Value)
+			if err != nil {
+				return nil, err
+			}
+			if item.HeadComment != nil {
+				node.HeadComment = *item.HeadComment
+			}
+			if item.LineComment != nil {
+				node.LineComment = *item.LineComment
+			}
+			if item.FootComment != nil {
+				node.FootComment = *item.FootComment
+			}
+			seq.Content = append(seq.Content, node)
+		}
+		return seq, nil
 	default:
-		return in
+		node := &yaml.Node{}
+		if err := node.Encode(in); err != nil {
+			return nil, fmt.Errorf("Error marshaling to yaml: %s", err)
+		}
+		return node, nil
 	}
 }
 
-func (store YAMLStore) treeBranchToYamlMap(in sops.TreeBranch) yaml.MapSlice {
-	branch := make(yaml.MapSlice, 0)
+// treeBranchToNode is the inverse of nodeToTreeBranch: it rebuilds a mapping
+// node from a TreeBranch, reattaching each item's comments. HeadComment and
+// FootComment are full lines before/after the entry, so they go on the key
+// node; LineComment is the trailing "# ..." on the `key: value` line, which
+// yaml.v3 expects on the value node (see lineComment). Either way, the
+// comment text itself is never encrypted, even when the value it's attached
+// to is -- comments were never secret to begin with.
+func (store YAMLStore) treeBranchToNode(in sops.TreeBranch) (*yaml.Node, error) {
+	node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
 	for _, item := range in {
-		branch = append(branch, yaml.MapItem{
-			Key:   item.Key,
-			Value: store.treeValueToYamlValue(item.Value),
-		})
+		keyNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: item.Key}
+		if item.HeadComment != nil {
+			keyNode.HeadComment = *item.HeadComment
+		}
+		if item.FootComment != nil {
+			keyNode.FootComment = *item.FootComment
+		}
+		valueNode, err := store.treeValueToNode(item.Value)
+		if err != nil {
+			return nil, err
+		}
+		if item.LineComment != nil {
+			valueNode.LineComment = *item.LineComment
+		}
+		node.Content = append(node.Content, keyNode, valueNode)
 	}
-	return branch
+	return node, nil
 }
 
-func (store YAMLStore) Dump(tree sops.TreeBranch) (string, error) {
-	yamlMap := store.treeBranchToYamlMap(tree)
-	out, err := yaml.Marshal(yamlMap)
-	if err != nil {
+// DumpAll serializes multiple TreeBranches back into a `---`-separated YAML
+// stream, one document per branch, in order.
+func (store YAMLStore) DumpAll(trees []sops.TreeBranch) (string, error) {
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	for _, tree := range trees {
+		node, err := store.treeBranchToNode(tree)
+		if err != nil {
+			return "", err
+		}
+		if err := encoder.Encode(node); err != nil {
+			return "", fmt.Errorf("Error marshaling to yaml: %s", err)
+		}
+	}
+	if err := encoder.Close(); err != nil {
 		return "", fmt.Errorf("Error marshaling to yaml: %s", err)
 	}
-	return string(out), nil
+	return out.String(), nil
 }
 
-func (store YAMLStore) DumpWithMetadata(tree sops.TreeBranch, metadata sops.Metadata) (string, error) {
-	yamlMap := store.treeBranchToYamlMap(tree)
-	yamlMap = append(yamlMap, yaml.MapItem{Key: "sops", Value: metadata.ToMap()})
-	out, err := yaml.Marshal(yamlMap)
-	if err != nil {
+// Dump serializes a single TreeBranch. For multi-document streams, use
+// DumpAll.
+func (store YAMLStore) Dump(tree sops.TreeBranch) (string, error) {
+	return store.DumpAll([]sops.TreeBranch{tree})
+}
+
+// DumpAllWithMetadata serializes a multi-document YAML stream, attaching the
+// sops metadata block to the last document only -- so a single-document
+// stream comes out as that one document with the sops key appended, not as
+// a second document holding only the metadata.
+func (store YAMLStore) DumpAllWithMetadata(trees []sops.TreeBranch, metadata sops.Metadata) (string, error) {
+	if len(trees) == 0 {
+		return "", fmt.Errorf("Cannot dump an empty document stream")
+	}
+	nodes := make([]*yaml.Node, len(trees))
+	for i, tree := range trees {
+		node, err := store.treeBranchToNode(tree)
+		if err != nil {
+			return "", err
+		}
+		nodes[i] = node
+	}
+
+	sopsNode := &yaml.Node{}
+	if err := sopsNode.Encode(metadata.ToMap()); err != nil {
+		return "", fmt.Errorf("Error marshaling sops metadata to yaml: %s", err)
+	}
+	sopsKeyNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "sops"}
+	// The sops metadata block isn't part of the user's document, so detach
+	// it visually with a leading blank line rather than butting it up
+	// against the last of the user's keys/comments.
+	sopsKeyNode.HeadComment = "\n"
+	last := nodes[len(nodes)-1]
+	last.Content = append(last.Content, sopsKeyNode, sopsNode)
+
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	for _, node := range nodes {
+		if err := encoder.Encode(node); err != nil {
+			return "", fmt.Errorf("Error marshaling to yaml: %s", err)
+		}
+	}
+	if err := encoder.Close(); err != nil {
 		return "", fmt.Errorf("Error marshaling to yaml: %s", err)
 	}
-	return string(out), nil
+	return out.String(), nil
+}
+
+// DumpWithMetadata serializes a single document with the sops metadata block
+// appended to it. For multi-document streams, use DumpAllWithMetadata.
+func (store YAMLStore) DumpWithMetadata(tree sops.TreeBranch, metadata sops.Metadata) (string, error) {
+	return store.DumpAllWithMetadata([]sops.TreeBranch{tree}, metadata)
 }
 
+// LoadMetadata scans a (possibly multi-document) YAML stream for the first
+// document carrying a top-level `sops` key and parses it into a
+// sops.Metadata. DumpAllWithMetadata only ever attaches that key to the last
+// document, but a stream that somehow carries more than one sops block with
+// conflicting unencrypted_suffix values is ambiguous about which suffix
+// should apply, so that's reported as an error rather than silently
+// resolved by picking the first one.
 func (store *YAMLStore) LoadMetadata(in string) (sops.Metadata, error) {
 	var metadata sops.Metadata
-	data := make(map[interface{}]interface{})
-	encoded := make(map[interface{}]interface{})
-	if err := yaml.Unmarshal([]byte(in), &encoded); err != nil {
-		return metadata, fmt.Errorf("Error unmarshalling input yaml: %s", err)
+	var found bool
+	var kmsErr error
+	decoder := yaml.NewDecoder(strings.NewReader(in))
+	for i := 0; ; i++ {
+		var encoded map[string]interface{}
+		err := decoder.Decode(&encoded)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return metadata, fmt.Errorf("Error unmarshalling input yaml: %s", err)
+		}
+		data, ok := encoded["sops"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		parsed, parseErr := store.metadataFromSopsMap(data)
+		// metadataFromSopsMap returns one of two things: a plain error (e.g.
+		// a malformed lastmodified) that means parsed isn't trustworthy at
+		// all, or a *kms.MultiError -- a failure to parse one or more (but
+		// not necessarily all) of the KMS entries -- alongside a parsed that
+		// is otherwise fully populated. Only the *kms.MultiError case is
+		// non-fatal, so it's carried forward and surfaced after the loop
+		// rather than discarding the metadata we just parsed.
+		if merr, ok := parseErr.(*kms.MultiError); ok {
+			kmsErr = merr
+		} else if parseErr != nil {
+			return metadata, parseErr
+		}
+		if found && parsed.UnencryptedSuffix != metadata.UnencryptedSuffix {
+			return metadata, fmt.Errorf("Document %d has a conflicting unencrypted_suffix in its sops metadata", i)
+		}
+		if !found {
+			metadata, found = parsed, true
+		}
 	}
-
-	sopsYaml, err := yaml.Marshal(encoded["sops"])
-	if err != nil {
-		return metadata, err
+	if !found {
+		return metadata, fmt.Errorf("No sops metadata found")
 	}
+	return metadata, kmsErr
+}
 
-	err = yaml.Unmarshal(sopsYaml, &data)
-	if err != nil {
-		return metadata, err
-	}
+// metadataFromSopsMap parses the `sops` block of a single document into a
+// sops.Metadata. A KMS entry that fails to parse (see kmsEntries) is
+// returned alongside the metadata rather than in place of it: the keysource
+// still carries whichever entries parsed cleanly, so callers still get a
+// usable Metadata and can decide what to do about the bad entry.
+func (store *YAMLStore) metadataFromSopsMap(data map[string]interface{}) (sops.Metadata, error) {
+	var metadata sops.Metadata
 	metadata.MessageAuthenticationCode = data["mac"].(string)
 	lastModified, err := time.Parse(sops.DateFormat, data["lastmodified"].(string))
 	if err != nil {
@@ -131,12 +407,13 @@ func (store *YAMLStore) LoadMetadata(in string) (sops.Metadata, error) {
 	metadata.LastModified = lastModified
 	metadata.UnencryptedSuffix = data["unencrypted_suffix"].(string)
 	metadata.Version = data["version"].(string)
+	var kmsErr error
 	if k, ok := data["kms"].([]interface{}); ok {
 		ks, err := store.kmsEntries(k)
-		if err == nil {
+		kmsErr = err
+		if len(ks.Keys) > 0 {
 			metadata.KeySources = append(metadata.KeySources, ks)
 		}
-
 	}
 
 	if pgp, ok := data["pgp"].([]interface{}); ok {
@@ -145,14 +422,24 @@ func (store *YAMLStore) LoadMetadata(in string) (sops.Metadata, error) {
 			metadata.KeySources = append(metadata.KeySources, ks)
 		}
 	}
-	return metadata, nil
+	return metadata, kmsErr
 }
 
+// kmsEntries parses the `kms` block of the sops metadata into a KeySource.
+// An entry whose created_at can't be parsed is skipped rather than aborting
+// the whole file: as long as one of the listed KMS keys parses, the file
+// remains usable. Skipped entries' errors are returned together as a
+// *kms.MultiError; note this only reflects parse failures in the metadata
+// block itself -- a key's CMK being disabled, access-denied, pending
+// deletion, or not found is only discovered later, when
+// kms.KMSMasterKey.Decrypt actually calls KMS and classifies the error (see
+// kms.ClassifyError).
 func (store *YAMLStore) kmsEntries(in []interface{}) (sops.KeySource, error) {
 	var keys []sops.MasterKey
 	keysource := sops.KeySource{Name: "kms", Keys: keys}
+	var merr *kms.MultiError
 	for _, v := range in {
-		entry := v.(map[interface{}]interface{})
+		entry := v.(map[string]interface{})
 		key := &kms.KMSMasterKey{}
 		key.Arn = entry["arn"].(string)
 		key.EncryptedKey = entry["enc"].(string)
@@ -162,19 +449,20 @@ func (store *YAMLStore) kmsEntries(in []interface{}) (sops.KeySource, error) {
 		}
 		creationDate, err := time.Parse(sops.DateFormat, entry["created_at"].(string))
 		if err != nil {
-			return keysource, fmt.Errorf("Could not parse creation date: %s", err)
+			merr = merr.Append(fmt.Errorf("Could not parse creation date for KMS key %q: %s", key.Arn, err))
+			continue
 		}
 		key.CreationDate = creationDate
 		keysource.Keys = append(keysource.Keys, key)
 	}
-	return keysource, nil
+	return keysource, merr.ErrorOrNil()
 }
 
 func (store *YAMLStore) pgpEntries(in []interface{}) (sops.KeySource, error) {
 	var keys []sops.MasterKey
 	keysource := sops.KeySource{Name: "pgp", Keys: keys}
 	for _, v := range in {
-		entry := v.(map[interface{}]interface{})
+		entry := v.(map[string]interface{})
 		key := &pgp.GPGMasterKey{}
 		key.Fingerprint = entry["fp"].(string)
 		key.EncryptedKey = entry["enc"].(string)
@@ -0,0 +1,181 @@
+package yaml
+
+import (
+	"strings"
+	"testing"
+
+	"go.mozilla.org/sops"
+)
+
+func TestLoadPreservesHeadComment(t *testing.T) {
+	in := "# this is a head comment\nfoo: bar\n"
+	branch, err := YAMLStore{}.Load(in)
+	if err != nil {
+		t.Fatalf("Load returned an error: %s", err)
+	}
+	if len(branch) != 1 {
+		t.Fatalf("expected 1 item, got %d", len(branch))
+	}
+	if branch[0].HeadComment == nil || *branch[0].HeadComment != "# this is a head comment" {
+		t.Fatalf("expected head comment to be preserved, got %v", branch[0].HeadComment)
+	}
+
+	out, err := YAMLStore{}.Dump(branch)
+	if err != nil {
+		t.Fatalf("Dump returned an error: %s", err)
+	}
+	if !strings.Contains(out, "# this is a head comment") {
+		t.Fatalf("expected dumped output to contain the head comment, got:\n%s", out)
+	}
+}
+
+func TestLoadPreservesInlineCommentOnScalar(t *testing.T) {
+	in := "foo: bar # trailing comment\n"
+	branch, err := YAMLStore{}.Load(in)
+	if err != nil {
+		t.Fatalf("Load returned an error: %s", err)
+	}
+	if len(branch) != 1 {
+		t.Fatalf("expected 1 item, got %d", len(branch))
+	}
+	if branch[0].LineComment == nil || *branch[0].LineComment != "# trailing comment" {
+		t.Fatalf("expected inline comment to be preserved, got %v", branch[0].LineComment)
+	}
+
+	out, err := YAMLStore{}.Dump(branch)
+	if err != nil {
+		t.Fatalf("Dump returned an error: %s", err)
+	}
+	if !strings.Contains(out, "foo: bar # trailing comment") {
+		t.Fatalf("expected dumped output to keep the comment on the value line, got:\n%s", out)
+	}
+}
+
+// TestDumpWithMetadataBlankLineBeforeSopsBlock covers the blank-line
+// separator DumpAllWithMetadata inserts before the sops metadata key (see
+// the sopsKeyNode.HeadComment = "\n" trick in store.go): a previous yaml.v3
+// upgrade could silently stop honoring a HeadComment of just "\n", so this
+// pins the behavior.
+func TestDumpWithMetadataBlankLineBeforeSopsBlock(t *testing.T) {
+	branch := sops.TreeBranch{{Key: "foo", Value: "bar"}}
+	out, err := YAMLStore{}.DumpWithMetadata(branch, sops.Metadata{Version: "3.7.1"})
+	if err != nil {
+		t.Fatalf("DumpWithMetadata returned an error: %s", err)
+	}
+	if !strings.Contains(out, "foo: bar\n\nsops:") {
+		t.Fatalf("expected a blank line between the user content and the sops block, got:\n%s", out)
+	}
+}
+
+func TestLoadPreservesBlankLineBetweenTopLevelKeys(t *testing.T) {
+	in := "foo: bar\n\nbaz: qux\n"
+	branch, err := YAMLStore{}.Load(in)
+	if err != nil {
+		t.Fatalf("Load returned an error: %s", err)
+	}
+	if len(branch) != 2 {
+		t.Fatalf("expected 2 items, got %d", len(branch))
+	}
+	if branch[1].HeadComment == nil || *branch[1].HeadComment != "\n" {
+		t.Fatalf("expected the blank line before %q to be preserved as a leading newline in its head comment, got %v", branch[1].Key, branch[1].HeadComment)
+	}
+
+	out, err := YAMLStore{}.Dump(branch)
+	if err != nil {
+		t.Fatalf("Dump returned an error: %s", err)
+	}
+	if !strings.Contains(out, "foo: bar\n\nbaz: qux") {
+		t.Fatalf("expected dumped output to keep the blank line between top-level keys, got:\n%s", out)
+	}
+}
+
+// TestLoadPreservesMultipleBlankLinesAndCommentTogether covers the general
+// case: the gap between the previous item and a following comment block is
+// measured in source lines (store.go's commentLineCount/lastLine), not just
+// detected as present or absent, so two blank lines followed by a head
+// comment must come back as two, not one.
+func TestLoadPreservesMultipleBlankLinesAndCommentTogether(t *testing.T) {
+	in := "foo: bar\n\n\n# a comment\nbaz: qux\n"
+	branch, err := YAMLStore{}.Load(in)
+	if err != nil {
+		t.Fatalf("Load returned an error: %s", err)
+	}
+	if len(branch) != 2 {
+		t.Fatalf("expected 2 items, got %d", len(branch))
+	}
+	if branch[1].HeadComment == nil || *branch[1].HeadComment != "\n\n# a comment" {
+		t.Fatalf("expected 2 leading blank lines followed by the comment, got %v", branch[1].HeadComment)
+	}
+
+	out, err := YAMLStore{}.Dump(branch)
+	if err != nil {
+		t.Fatalf("Dump returned an error: %s", err)
+	}
+	if !strings.Contains(out, "foo: bar\n\n\n# a comment\nbaz: qux") {
+		t.Fatalf("expected dumped output to reproduce the input exactly, got:\n%s", out)
+	}
+}
+
+func TestLoadPreservesSequenceItemComments(t *testing.T) {
+	in := "items:\n  # head comment\n  - foo # line comment\n  - bar\n"
+	branch, err := YAMLStore{}.Load(in)
+	if err != nil {
+		t.Fatalf("Load returned an error: %s", err)
+	}
+	if len(branch) != 1 {
+		t.Fatalf("expected 1 item, got %d", len(branch))
+	}
+	items, ok := branch[0].Value.([]sops.SequenceItem)
+	if !ok {
+		t.Fatalf("expected %q's value to be a []sops.SequenceItem, got %T", branch[0].Key, branch[0].Value)
+	}
+	if len(items) != 2 {
+		t.Fatalf("expected 2 sequence items, got %d", len(items))
+	}
+	if items[0].HeadComment == nil || *items[0].HeadComment != "# head comment" {
+		t.Fatalf("expected the first item's head comment to be preserved, got %v", items[0].HeadComment)
+	}
+	if items[0].LineComment == nil || *items[0].LineComment != "# line comment" {
+		t.Fatalf("expected the first item's line comment to be preserved, got %v", items[0].LineComment)
+	}
+	if items[1].HeadComment != nil {
+		t.Fatalf("expected the second item to have no head comment, got %v", items[1].HeadComment)
+	}
+
+	out, err := YAMLStore{}.Dump(branch)
+	if err != nil {
+		t.Fatalf("Dump returned an error: %s", err)
+	}
+	if !strings.Contains(out, "# head comment") || !strings.Contains(out, "foo # line comment") {
+		t.Fatalf("expected dumped output to keep the sequence item comments, got:\n%s", out)
+	}
+}
+
+func TestLoadPreservesCommentsInNestedMaps(t *testing.T) {
+	in := "parent:\n  # nested head comment\n  child: value\n"
+	branch, err := YAMLStore{}.Load(in)
+	if err != nil {
+		t.Fatalf("Load returned an error: %s", err)
+	}
+	if len(branch) != 1 {
+		t.Fatalf("expected 1 item, got %d", len(branch))
+	}
+	nested, ok := branch[0].Value.(sops.TreeBranch)
+	if !ok {
+		t.Fatalf("expected %q's value to be a nested TreeBranch, got %T", branch[0].Key, branch[0].Value)
+	}
+	if len(nested) != 1 {
+		t.Fatalf("expected 1 nested item, got %d", len(nested))
+	}
+	if nested[0].HeadComment == nil || *nested[0].HeadComment != "# nested head comment" {
+		t.Fatalf("expected nested head comment to be preserved, got %v", nested[0].HeadComment)
+	}
+
+	out, err := YAMLStore{}.Dump(branch)
+	if err != nil {
+		t.Fatalf("Dump returned an error: %s", err)
+	}
+	if !strings.Contains(out, "# nested head comment") {
+		t.Fatalf("expected dumped output to contain the nested head comment, got:\n%s", out)
+	}
+}